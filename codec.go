@@ -0,0 +1,169 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/proto"
+)
+
+// Codec controls how Call marshals a request and unmarshals a response.
+type Codec interface {
+	// ContentType is published as Properties.ContentType on the request.
+	ContentType() string
+	// Encode marshals req into the Publish payload.
+	Encode(req any) ([]byte, error)
+	// Decode unmarshals a response payload into resp, which is always a
+	// pointer to the caller's Resp type. Decode is also where a codec that
+	// carries remote errors in-band (e.g. CloudEventsCodec) should surface
+	// them instead of populating resp.
+	Decode(payload []byte, resp any) error
+}
+
+// ErrorUserProperty is the MQTT5 user-property key a Responder sets (and Call
+// checks) to carry a handler error back to the caller instead of a payload.
+const ErrorUserProperty = "error"
+
+// remoteError extracts a remote-side error reported via ErrorUserProperty.
+func remoteError(pb *paho.Publish) error {
+	if pb.Properties == nil {
+		return nil
+	}
+
+	if msg := pb.Properties.User.Get(ErrorUserProperty); msg != "" {
+		return fmt.Errorf("remote error: %s", msg)
+	}
+
+	return nil
+}
+
+// JSONCodec encodes requests and responses as JSON. It is Call's default codec.
+type JSONCodec struct{}
+
+func (JSONCodec) ContentType() string { return "application/json" }
+
+func (JSONCodec) Encode(req any) ([]byte, error) { return json.Marshal(req) }
+
+func (JSONCodec) Decode(payload []byte, resp any) error { return json.Unmarshal(payload, resp) }
+
+// ProtobufCodec encodes requests and responses as binary protocol buffers.
+// Req and Resp must implement proto.Message.
+type ProtobufCodec struct{}
+
+func (ProtobufCodec) ContentType() string { return "application/protobuf" }
+
+func (ProtobufCodec) Encode(req any) ([]byte, error) {
+	msg, ok := req.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("rpc: %T does not implement proto.Message", req)
+	}
+
+	return proto.Marshal(msg)
+}
+
+func (ProtobufCodec) Decode(payload []byte, resp any) error {
+	msg, ok := resp.(proto.Message)
+	if !ok {
+		return fmt.Errorf("rpc: %T does not implement proto.Message", resp)
+	}
+
+	return proto.Unmarshal(payload, msg)
+}
+
+// CloudEventsCodec wraps requests and responses in a CloudEvents
+// structured-mode JSON envelope. Its Decode also surfaces a remote error
+// carried as the event's "error" extension; Call still checks
+// ErrorUserProperty first, as it does for every codec.
+type CloudEventsCodec struct {
+	// Source and Type are set on every outgoing event, per the CloudEvents spec.
+	Source string
+	Type   string
+}
+
+func (c CloudEventsCodec) ContentType() string { return "application/cloudevents+json" }
+
+func (c CloudEventsCodec) Encode(req any) ([]byte, error) {
+	e := cloudevents.NewEvent()
+	e.SetSource(c.Source)
+	e.SetType(c.Type)
+	e.SetID(uuid.NewString())
+
+	if err := e.SetData(cloudevents.ApplicationJSON, req); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(e)
+}
+
+func (c CloudEventsCodec) Decode(payload []byte, resp any) error {
+	var e cloudevents.Event
+	if err := json.Unmarshal(payload, &e); err != nil {
+		return err
+	}
+
+	if msg, ok := e.Extensions()[ErrorUserProperty].(string); ok && msg != "" {
+		return fmt.Errorf("remote error: %s", msg)
+	}
+
+	return e.DataAs(resp)
+}
+
+// CallOption customizes a single Call.
+type CallOption func(*callConfig)
+
+type callConfig struct {
+	codec Codec
+}
+
+// WithCodec overrides the codec used to encode the request and decode the
+// response. Call uses JSONCodec by default.
+func WithCodec(codec Codec) CallOption {
+	return func(cc *callConfig) {
+		cc.codec = codec
+	}
+}
+
+// Call publishes req on topic, waits for the matching response via
+// h.Request, and decodes it into a Resp. It removes the need for callers to
+// hand-build a paho.Publish and marshal/unmarshal the payload themselves.
+func Call[Req any, Resp any](ctx context.Context, h *Handler, topic string, req Req, opts ...CallOption) (Resp, error) {
+	var zero Resp
+
+	cfg := callConfig{codec: JSONCodec{}}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	body, err := cfg.codec.Encode(req)
+	if err != nil {
+		return zero, err
+	}
+
+	pb := &paho.Publish{
+		Topic:   topic,
+		Payload: body,
+		Properties: &paho.PublishProperties{
+			ContentType: cfg.codec.ContentType(),
+		},
+	}
+
+	respPb, err := h.Request(ctx, pb)
+	if err != nil {
+		return zero, err
+	}
+
+	if err := remoteError(respPb); err != nil {
+		return zero, err
+	}
+
+	var resp Resp
+	if err := cfg.codec.Decode(respPb.Payload, &resp); err != nil {
+		return zero, err
+	}
+
+	return resp, nil
+}
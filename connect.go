@@ -0,0 +1,74 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// mqttConnect starts an autopaho.ConnectionManager that keeps the connection
+// to one of in.BrokerURLs alive, re-subscribing the Handler's responses topic
+// on every (re)connect and draining in-flight requests whenever it drops.
+func mqttConnect(ctx context.Context, clientID string, router *paho.StandardRouter, h *Handler, in HandlerInput) (*autopaho.ConnectionManager, error) {
+	responseTopic := fmt.Sprintf("%s/responses", clientID)
+
+	// connectionDown fails every in-flight request with ErrDisconnected and
+	// notifies the caller once an established connection is lost.
+	connectionDown := func() {
+		h.drainCorrelData()
+		if in.OnConnectionDown != nil {
+			in.OnConnectionDown()
+		}
+	}
+
+	cliCfg := autopaho.ClientConfig{
+		ServerUrls:        in.BrokerURLs,
+		KeepAlive:         in.KeepAlive,
+		ConnectRetryDelay: in.ConnectRetryDelay,
+		ConnectTimeout:    in.ConnectTimeout,
+		TlsCfg:            in.TLSConfig,
+		OnConnectionUp: func(cm *autopaho.ConnectionManager, connAck *paho.Connack) {
+			_, err := cm.Subscribe(ctx, &paho.Subscribe{
+				Subscriptions: []paho.SubscribeOptions{
+					{Topic: responseTopic, QoS: 1},
+				},
+			})
+			if err != nil {
+				// Requests already in flight can no longer receive a reply.
+				h.drainCorrelData()
+				if in.OnConnectionDown != nil {
+					in.OnConnectionDown()
+				}
+				return
+			}
+
+			if in.OnConnectionUp != nil {
+				in.OnConnectionUp(cm, connAck)
+			}
+		},
+		OnConnectError: func(err error) {
+			h.drainCorrelData()
+
+			if in.OnConnectionDown != nil {
+				in.OnConnectionDown()
+			}
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID:           clientID,
+			Router:             router,
+			OnClientError:      func(error) { connectionDown() },
+			OnServerDisconnect: func(*paho.Disconnect) { connectionDown() },
+		},
+	}
+
+	if in.Username != nil {
+		cliCfg.ConnectUsername = *in.Username
+	}
+	if in.Password != nil {
+		cliCfg.ConnectPassword = []byte(*in.Password)
+	}
+
+	return autopaho.NewConnection(ctx, cliCfg)
+}
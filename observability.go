@@ -0,0 +1,135 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer is shared by every Handler; OTel tracers are safe for concurrent use
+// and cheap to look up, so there's no need to thread one through HandlerInput.
+var tracer = otel.Tracer("github.com/yogihardi/paho-mqtt-rpc")
+
+var (
+	requestsInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "paho_mqtt_rpc",
+		Name:      "requests_in_flight",
+		Help:      "Number of RPC requests currently awaiting a response.",
+	}, []string{"topic"})
+
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "paho_mqtt_rpc",
+		Name:      "requests_total",
+		Help:      "Completed RPC requests, by topic and outcome.",
+	}, []string{"topic", "outcome"})
+
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "paho_mqtt_rpc",
+		Name:      "request_duration_seconds",
+		Help:      "RPC request latency, by topic.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"topic"})
+
+	lateResponsesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "paho_mqtt_rpc",
+		Name:      "late_responses_total",
+		Help:      "Responses received with no matching in-flight request, e.g. after a timeout.",
+	}, []string{"topic"})
+)
+
+// userPropertyCarrier adapts paho.PublishProperties.User to otel's
+// propagation.TextMapCarrier, so an OTel trace context can ride along as MQTT5
+// user properties using the W3C traceparent convention.
+type userPropertyCarrier struct {
+	props *paho.PublishProperties
+}
+
+func (c userPropertyCarrier) Get(key string) string {
+	return c.props.User.Get(key)
+}
+
+func (c userPropertyCarrier) Set(key, value string) {
+	c.props.User.Add(key, value)
+}
+
+func (c userPropertyCarrier) Keys() []string {
+	keys := make([]string, len(c.props.User))
+	for i, p := range c.props.User {
+		keys[i] = p.Key
+	}
+
+	return keys
+}
+
+// startRequestSpan starts a span around a Request call and injects the
+// current trace context into pb's user properties so a Responder on the
+// other end can continue the same trace.
+func startRequestSpan(ctx context.Context, pb *paho.Publish) (context.Context, trace.Span) {
+	ctx, span := tracer.Start(ctx, "mqtt_rpc.request", trace.WithAttributes(
+		attribute.String("messaging.destination", pb.Topic),
+	))
+
+	otel.GetTextMapPropagator().Inject(ctx, userPropertyCarrier{props: pb.Properties})
+
+	return ctx, span
+}
+
+// requestOutcome labels a completed Request for requestsTotal.
+func requestOutcome(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.Is(err, ErrRequestTimeout):
+		return "timeout"
+	case errors.Is(err, ErrDisconnected):
+		return "disconnected"
+	case errors.Is(err, ErrCorrelationDataSet):
+		return "invalid_request"
+	case errors.Is(err, ErrTooManyRequests):
+		return "too_many_requests"
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return "canceled"
+	default:
+		return "error"
+	}
+}
+
+func (h *Handler) logger() *slog.Logger {
+	if h.log != nil {
+		return h.log
+	}
+
+	return slog.Default()
+}
+
+// instrumentRequest wraps a Request call with tracing, Prometheus metrics, and
+// structured logging. It returns the (possibly trace-carrying) context to
+// publish with and a finish func the caller must invoke with the eventual
+// error once the request completes.
+func (h *Handler) instrumentRequest(ctx context.Context, pb *paho.Publish) (context.Context, func(error)) {
+	topic := pb.Topic
+	start := time.Now()
+
+	requestsInFlight.WithLabelValues(topic).Inc()
+	ctx, span := startRequestSpan(ctx, pb)
+
+	return ctx, func(err error) {
+		requestsInFlight.WithLabelValues(topic).Dec()
+		requestDuration.WithLabelValues(topic).Observe(time.Since(start).Seconds())
+		requestsTotal.WithLabelValues(topic, requestOutcome(err)).Inc()
+
+		if err != nil {
+			span.RecordError(err)
+			h.logger().Debug("mqtt rpc request failed", "topic", topic, "error", err)
+		}
+		span.End()
+	}
+}
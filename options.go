@@ -0,0 +1,52 @@
+package rpc
+
+// RequestOptions configures a single Request call: the QoS, Retain flag,
+// message expiry, content type and user properties it publishes with, so
+// callers can match non-Go MQTT5 RPC peers that expect specific
+// QoS/retain/expiry semantics. Request itself refuses a Publish whose
+// Properties.CorrelationData is already set (ErrCorrelationDataSet) and
+// always sets Properties.ResponseTopic to the Handler's responses topic.
+type RequestOptions struct {
+	QoS            *byte
+	Retain         *bool
+	MessageExpiry  *uint32
+	ContentType    string
+	UserProperties map[string]string
+}
+
+// RequestOption customizes a single Request call.
+type RequestOption func(*RequestOptions)
+
+// WithQoS sets the QoS Request publishes with. Request still defaults to
+// whatever QoS the caller put on the Publish when this option is omitted.
+func WithQoS(qos byte) RequestOption {
+	return func(o *RequestOptions) { o.QoS = &qos }
+}
+
+// WithRetain sets the Retain flag Request publishes with. Request defaults
+// to false when this option is omitted, as it always has.
+func WithRetain(retain bool) RequestOption {
+	return func(o *RequestOptions) { o.Retain = &retain }
+}
+
+// WithMessageExpiry sets Properties.MessageExpiryInterval, in seconds, on the
+// outgoing request.
+func WithMessageExpiry(seconds uint32) RequestOption {
+	return func(o *RequestOptions) { o.MessageExpiry = &seconds }
+}
+
+// WithUserProperty adds a user property to the outgoing request. It may be
+// called more than once to add several.
+func WithUserProperty(key, value string) RequestOption {
+	return func(o *RequestOptions) {
+		if o.UserProperties == nil {
+			o.UserProperties = make(map[string]string)
+		}
+		o.UserProperties[key] = value
+	}
+}
+
+// WithContentType sets Properties.ContentType on the outgoing request.
+func WithContentType(contentType string) RequestOption {
+	return func(o *RequestOptions) { o.ContentType = contentType }
+}
@@ -0,0 +1,243 @@
+package rpc
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/google/uuid"
+)
+
+// defaultResponderConcurrency bounds how many requests a Responder will
+// process at once when ResponderInput.Concurrency is left unset.
+const defaultResponderConcurrency = 16
+
+// HandlerFunc processes one incoming RPC request and returns the Publish to
+// send back. A nil response (with a nil error) means no reply is sent.
+type HandlerFunc func(ctx context.Context, pb *paho.Publish) (*paho.Publish, error)
+
+// Responder is the server side of request/reply: it subscribes to one or more
+// request topics (which may use MQTT5 `+` wildcards) and, for every message
+// whose Properties.ResponseTopic and CorrelationData are set, dispatches it to
+// the HandlerFunc registered for that topic filter and publishes the result
+// back to ResponseTopic with the same correlation data.
+type Responder struct {
+	sync.Mutex
+	cm        *autopaho.ConnectionManager
+	clientID  string
+	router    *paho.StandardRouter
+	topics    map[string]HandlerFunc
+	sem       chan struct{}
+	groupName string
+}
+
+type ResponderInput struct {
+	BrokerURLs        []*url.URL
+	Username          *string
+	Password          *string
+	KeepAlive         uint16
+	ConnectRetryDelay time.Duration
+	ConnectTimeout    time.Duration
+	TLSConfig         *tls.Config
+
+	// Concurrency bounds how many HandleFunc calls run at once. Defaults to
+	// defaultResponderConcurrency.
+	Concurrency int
+
+	// GroupName, if set, makes every subscription a shared subscription
+	// (`$share/{GroupName}/{topic}`): multiple Responder instances using the
+	// same GroupName and topics load-balance incoming requests across the
+	// group instead of each instance receiving every request. Responses are
+	// unaffected - a handler always replies to the requester's ResponseTopic,
+	// which travels in the request itself, not to the group.
+	GroupName string
+}
+
+func NewResponder(ctx context.Context, in ResponderInput) (*Responder, error) {
+	concurrency := in.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultResponderConcurrency
+	}
+
+	r := &Responder{
+		clientID:  uuid.NewString(),
+		router:    paho.NewStandardRouter(),
+		topics:    make(map[string]HandlerFunc),
+		sem:       make(chan struct{}, concurrency),
+		groupName: in.GroupName,
+	}
+
+	cm, err := responderConnect(ctx, r, in)
+	if err != nil {
+		return nil, err
+	}
+	r.cm = cm
+
+	if err := cm.AwaitConnection(ctx); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func responderConnect(ctx context.Context, r *Responder, in ResponderInput) (*autopaho.ConnectionManager, error) {
+	cliCfg := autopaho.ClientConfig{
+		ServerUrls:        in.BrokerURLs,
+		KeepAlive:         in.KeepAlive,
+		ConnectRetryDelay: in.ConnectRetryDelay,
+		ConnectTimeout:    in.ConnectTimeout,
+		TlsCfg:            in.TLSConfig,
+		OnConnectionUp: func(cm *autopaho.ConnectionManager, _ *paho.Connack) {
+			r.resubscribeAll(ctx, cm)
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID: r.clientID,
+			Router:   r.router,
+		},
+	}
+
+	if in.Username != nil {
+		cliCfg.ConnectUsername = *in.Username
+	}
+	if in.Password != nil {
+		cliCfg.ConnectPassword = []byte(*in.Password)
+	}
+
+	return autopaho.NewConnection(ctx, cliCfg)
+}
+
+// HandleFunc registers fn for topic (which may contain MQTT5 `+` wildcards)
+// and subscribes to it. Calling HandleFunc again for the same topic replaces
+// its handler.
+func (r *Responder) HandleFunc(topic string, fn HandlerFunc) error {
+	r.Lock()
+	r.topics[topic] = fn
+	r.Unlock()
+
+	// StandardRouter appends handlers per topic; drop any earlier one first.
+	r.router.UnregisterHandler(topic)
+	r.router.RegisterHandler(topic, r.wrapHandler(fn))
+
+	_, err := r.cm.Subscribe(context.Background(), &paho.Subscribe{
+		Subscriptions: []paho.SubscribeOptions{
+			{Topic: r.subscriptionTopic(topic), QoS: 1},
+		},
+	})
+
+	return err
+}
+
+// subscriptionTopic returns the filter actually sent in a Subscribe packet
+// for topic: unchanged, or wrapped as a shared subscription when GroupName
+// is set. The router, and thus HandleFunc's lookup, keeps using the plain
+// topic, since the broker strips the `$share/{group}/` prefix before
+// delivering a message to the client.
+func (r *Responder) subscriptionTopic(topic string) string {
+	if r.groupName == "" {
+		return topic
+	}
+
+	return fmt.Sprintf("$share/%s/%s", r.groupName, topic)
+}
+
+// subscriptions builds the Subscriptions list for every registered topic,
+// applying subscriptionTopic so callers never have to reason about the
+// `$share/` prefix themselves.
+func (r *Responder) subscriptions() []paho.SubscribeOptions {
+	r.Lock()
+	defer r.Unlock()
+
+	subs := make([]paho.SubscribeOptions, 0, len(r.topics))
+	for topic := range r.topics {
+		subs = append(subs, paho.SubscribeOptions{Topic: r.subscriptionTopic(topic), QoS: 1})
+	}
+
+	return subs
+}
+
+// resubscribeAll re-subscribes every registered topic after a reconnect,
+// since autopaho starts each new MQTT session clean.
+func (r *Responder) resubscribeAll(ctx context.Context, cm *autopaho.ConnectionManager) {
+	subs := r.subscriptions()
+	if len(subs) == 0 {
+		return
+	}
+
+	cm.Subscribe(ctx, &paho.Subscribe{Subscriptions: subs})
+}
+
+// wrapHandler adapts fn to the Router's callback shape: it ignores requests
+// with no response topic/correlation data, then spawns a goroutine that waits
+// for a worker-pool slot before running fn. The semaphore must be acquired
+// inside the goroutine, not the callback itself - the callback runs on the
+// same Paho router/read goroutine that feeds every topic this Responder owns,
+// so blocking it here to wait for a slot would stall the whole subscription
+// once Concurrency handlers are busy.
+func (r *Responder) wrapHandler(fn HandlerFunc) func(*paho.Publish) {
+	return func(pb *paho.Publish) {
+		if pb.Properties == nil || pb.Properties.ResponseTopic == "" || pb.Properties.CorrelationData == nil {
+			return
+		}
+
+		go func() {
+			r.sem <- struct{}{}
+			defer func() { <-r.sem }()
+			r.handle(fn, pb)
+		}()
+	}
+}
+
+// handle runs fn with a context derived from the request's MQTT5
+// MessageExpiryInterval (if any), turns a panic or error into an error
+// response, and publishes the result back to pb.Properties.ResponseTopic.
+func (r *Responder) handle(fn HandlerFunc, pb *paho.Publish) {
+	ctx := context.Background()
+	if pb.Properties.MessageExpiry != nil && *pb.Properties.MessageExpiry > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(*pb.Properties.MessageExpiry)*time.Second)
+		defer cancel()
+	}
+
+	resp, err := r.invoke(ctx, fn, pb)
+	if err != nil {
+		resp = errorResponse(err)
+	}
+	if resp == nil {
+		return
+	}
+
+	resp.Topic = pb.Properties.ResponseTopic
+	if resp.Properties == nil {
+		resp.Properties = &paho.PublishProperties{}
+	}
+	resp.Properties.CorrelationData = pb.Properties.CorrelationData
+
+	if _, err := r.cm.Publish(ctx, resp); err != nil {
+		slog.Default().Warn("rpc: failed to publish response", "topic", resp.Topic, "error", err)
+	}
+}
+
+// invoke runs fn, converting a panic into an error so a crashing handler
+// cannot take the subscription down.
+func (r *Responder) invoke(ctx context.Context, fn HandlerFunc, pb *paho.Publish) (resp *paho.Publish, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("rpc: handler panicked: %v", p)
+		}
+	}()
+
+	return fn(ctx, pb)
+}
+
+func errorResponse(err error) *paho.Publish {
+	props := &paho.PublishProperties{}
+	props.User.Add(ErrorUserProperty, err.Error())
+
+	return &paho.Publish{Properties: props}
+}
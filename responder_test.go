@@ -0,0 +1,70 @@
+package rpc
+
+import (
+	"context"
+	"testing"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+func TestResponderSubscriptionTopic(t *testing.T) {
+	cases := []struct {
+		name      string
+		groupName string
+		topic     string
+		want      string
+	}{
+		{"no group", "", "svc/add", "svc/add"},
+		{"shared subscription", "workers", "svc/add", "$share/workers/svc/add"},
+		{"shared subscription with wildcard", "workers", "svc/+", "$share/workers/svc/+"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := &Responder{groupName: tc.groupName}
+
+			if got := r.subscriptionTopic(tc.topic); got != tc.want {
+				t.Errorf("subscriptionTopic(%q) = %q, want %q", tc.topic, got, tc.want)
+			}
+		})
+	}
+}
+
+// TestResponderSubscriptionsUseRegisteredTopic demonstrates horizontal
+// scaling of handlers: subscriptions() sends the `$share/{group}/` prefixed
+// filter to the broker, while the topics table stays keyed by the *plain*
+// topic (the one HandleFunc also registers on the router), since the broker
+// strips the prefix before delivering a message to whichever group member it
+// picks.
+func TestResponderSubscriptionsUseRegisteredTopic(t *testing.T) {
+	r := &Responder{
+		groupName: "workers",
+		topics: map[string]HandlerFunc{
+			"svc/add": nil,
+		},
+	}
+
+	subs := r.subscriptions()
+	if len(subs) != 1 || subs[0].Topic != "$share/workers/svc/add" {
+		t.Fatalf("subscriptions() = %v, want a single entry with Topic %q", subs, "$share/workers/svc/add")
+	}
+
+	if _, ok := r.topics["svc/add"]; !ok {
+		t.Fatalf("HandleFunc's dispatch table must keep the plain topic %q, got %v", "svc/add", r.topics)
+	}
+}
+
+// TestInvokeRecoversFromPanic ensures a crashing handler turns into an error
+// instead of a panic escaping the handler's goroutine and crashing the process.
+func TestInvokeRecoversFromPanic(t *testing.T) {
+	r := &Responder{}
+
+	panicking := func(ctx context.Context, pb *paho.Publish) (*paho.Publish, error) {
+		panic("boom")
+	}
+
+	_, err := r.invoke(context.Background(), panicking, &paho.Publish{})
+	if err == nil {
+		t.Fatal("invoke() error = nil, want non-nil after handler panic")
+	}
+}
@@ -2,95 +2,110 @@ package rpc
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
-	"net"
+	"log/slog"
+	"net/url"
 	"sync"
 	"time"
 
+	"github.com/eclipse/paho.golang/autopaho"
 	"github.com/eclipse/paho.golang/paho"
 	"github.com/google/uuid"
 )
 
 var (
 	ErrRequestTimeout = errors.New("request timeout")
+	// ErrDisconnected is returned by Request when the MQTT connection drops
+	// (or re-subscribing after a reconnect fails) while a request is in flight.
+	ErrDisconnected = errors.New("mqtt connection is down")
+	// ErrCorrelationDataSet is returned by Request when the caller has already
+	// set Properties.CorrelationData, instead of silently overwriting it.
+	ErrCorrelationDataSet = errors.New("rpc: Properties.CorrelationData already set")
+	// ErrTooManyRequests is returned by Request when HandlerInput.MaxInFlight
+	// requests are already outstanding and HandlerInput.MaxInFlightWait is false.
+	ErrTooManyRequests = errors.New("rpc: too many in-flight requests")
 )
 
 // Handler is the struct providing a request/response functionality for the paho
 // MQTT v5 client
 type Handler struct {
 	sync.Mutex
-	c              *paho.Client
+	cm             *autopaho.ConnectionManager
+	clientID       string
 	correlData     map[string]chan *paho.Publish
 	requestTimeout time.Duration
+	log            *slog.Logger
+
+	// inFlight bounds concurrent requests when HandlerInput.MaxInFlight > 0;
+	// nil otherwise, meaning no limit.
+	inFlight        chan struct{}
+	maxInFlightWait bool
 }
 
 type HandlerInput struct {
-	Server         string
 	Username       *string
 	Password       *string
 	RequestTimeout time.Duration
+
+	// BrokerURLs, KeepAlive, ConnectRetryDelay, ConnectTimeout and TLSConfig
+	// are passed straight through to the underlying autopaho.ConnectionManager,
+	// which keeps the connection alive across broker restarts and network drops.
+	BrokerURLs        []*url.URL
+	KeepAlive         uint16
+	ConnectRetryDelay time.Duration
+	ConnectTimeout    time.Duration
+	TLSConfig         *tls.Config
+
+	// OnConnectionUp, if set, is called after the Handler has re-subscribed to
+	// its own responses topic following a (re)connect.
+	OnConnectionUp func(cm *autopaho.ConnectionManager, connAck *paho.Connack)
+	// OnConnectionDown, if set, is called whenever the connection is lost.
+	// Requests in flight at that point fail with ErrDisconnected.
+	OnConnectionDown func()
+
+	// Logger receives structured logs about request/response handling.
+	// Defaults to slog.Default() when nil.
+	Logger *slog.Logger
+
+	// MaxInFlight caps the number of Request calls awaiting a response at
+	// once. Zero (the default) means no limit.
+	MaxInFlight int
+	// MaxInFlightWait, when true, makes Request block until a slot frees up
+	// (or ctx is done) instead of immediately failing with ErrTooManyRequests
+	// once MaxInFlight is reached.
+	MaxInFlightWait bool
 }
 
 func NewHandler(ctx context.Context, in HandlerInput) (*Handler, error) {
-	mqttClient, err := mqttConnect(ctx, in)
-	if err != nil {
-		return nil, err
-	}
+	clientID := uuid.NewString()
 
 	h := &Handler{
-		c:              mqttClient,
-		correlData:     make(map[string]chan *paho.Publish),
-		requestTimeout: in.RequestTimeout,
+		clientID:        clientID,
+		correlData:      make(map[string]chan *paho.Publish),
+		requestTimeout:  in.RequestTimeout,
+		log:             in.Logger,
+		maxInFlightWait: in.MaxInFlightWait,
 	}
-
-	h.c.Router.RegisterHandler(fmt.Sprintf("%s/responses", h.c.ClientID), h.responseHandler)
-
-	_, err = h.c.Subscribe(ctx, &paho.Subscribe{
-		Subscriptions: map[string]paho.SubscribeOptions{
-			fmt.Sprintf("%s/responses", h.c.ClientID): {QoS: 1},
-		},
-	})
-	if err != nil {
-		return nil, err
+	if in.MaxInFlight > 0 {
+		h.inFlight = make(chan struct{}, in.MaxInFlight)
 	}
 
-	return h, nil
-}
+	router := paho.NewStandardRouter()
+	router.RegisterHandler(fmt.Sprintf("%s/responses", clientID), h.responseHandler)
 
-func mqttConnect(ctx context.Context, in HandlerInput) (*paho.Client, error) {
-	conn, err := net.Dial("tcp", in.Server)
+	cm, err := mqttConnect(ctx, clientID, router, h, in)
 	if err != nil {
 		return nil, err
 	}
+	h.cm = cm
 
-	clientID := uuid.NewString()
-	c := paho.NewClient(paho.ClientConfig{
-		ClientID: clientID,
-		Conn:     conn,
-	})
-	cp := &paho.Connect{
-		KeepAlive:  30,
-		CleanStart: true,
-		ClientID:   clientID,
-	}
-	if in.Username != nil {
-		cp.UsernameFlag = true
-		cp.Username = *in.Username
-	}
-	if in.Password != nil {
-		cp.PasswordFlag = true
-		cp.Password = []byte(*in.Password)
-	}
-	ca, err := c.Connect(ctx, cp)
-	if err != nil {
+	if err := cm.AwaitConnection(ctx); err != nil {
 		return nil, err
 	}
-	if ca.ReasonCode != 0 {
-		return nil, fmt.Errorf("failed to connect to %s : %d - %s", in.Server, ca.ReasonCode, ca.Properties.ReasonString)
-	}
 
-	return c, nil
+	return h, nil
 }
 
 func (h *Handler) addCorrelID(cID string, r chan *paho.Publish) {
@@ -110,21 +125,97 @@ func (h *Handler) getCorrelIDChan(cID string) chan *paho.Publish {
 	return rChan
 }
 
-func (h *Handler) Request(ctx context.Context, pb *paho.Publish) (*paho.Publish, error) {
-	cID := uuid.New().String()
-	rChan := make(chan *paho.Publish)
+// removeCorrelID discards a correlation entry without waiting for a response,
+// so Request giving up via timeout or context cancellation doesn't leak it.
+func (h *Handler) removeCorrelID(cID string) {
+	h.Lock()
+	defer h.Unlock()
 
-	h.addCorrelID(cID, rChan)
+	delete(h.correlData, cID)
+}
+
+// drainCorrelData fails every outstanding request with ErrDisconnected instead
+// of leaving it to block until requestTimeout after the connection drops.
+func (h *Handler) drainCorrelData() {
+	h.Lock()
+	defer h.Unlock()
+
+	for cID, rChan := range h.correlData {
+		select {
+		case rChan <- nil:
+		default:
+			// rChan is buffered size-1 and its entry is removed on its only
+			// send, so this never blocks; if Request already gave up, the nil
+			// simply stays unread in the buffer.
+		}
+		delete(h.correlData, cID)
+	}
+}
+
+func (h *Handler) Request(ctx context.Context, pb *paho.Publish, opts ...RequestOption) (*paho.Publish, error) {
+	var ro RequestOptions
+	for _, opt := range opts {
+		opt(&ro)
+	}
 
 	if pb.Properties == nil {
 		pb.Properties = &paho.PublishProperties{}
+	} else if len(pb.Properties.CorrelationData) > 0 {
+		return nil, ErrCorrelationDataSet
+	}
+
+	var err error
+	ctx, finish := h.instrumentRequest(ctx, pb)
+	defer func() { finish(err) }()
+
+	if h.inFlight != nil {
+		if h.maxInFlightWait {
+			select {
+			case h.inFlight <- struct{}{}:
+			case <-ctx.Done():
+				err = ctx.Err()
+				return nil, err
+			}
+		} else {
+			select {
+			case h.inFlight <- struct{}{}:
+			default:
+				err = ErrTooManyRequests
+				return nil, err
+			}
+		}
+		defer func() { <-h.inFlight }()
 	}
 
+	cID := uuid.New().String()
+	rChan := make(chan *paho.Publish, 1)
+
+	h.addCorrelID(cID, rChan)
+
 	pb.Properties.CorrelationData = []byte(cID)
-	pb.Properties.ResponseTopic = fmt.Sprintf("%s/responses", h.c.ClientID)
+
+	pb.Properties.ResponseTopic = h.clientID + "/responses"
+
+	if ro.QoS != nil {
+		pb.QoS = *ro.QoS
+	}
+
 	pb.Retain = false
+	if ro.Retain != nil {
+		pb.Retain = *ro.Retain
+	}
+
+	if ro.MessageExpiry != nil {
+		pb.Properties.MessageExpiry = ro.MessageExpiry
+	}
+	if ro.ContentType != "" {
+		pb.Properties.ContentType = ro.ContentType
+	}
+	for k, v := range ro.UserProperties {
+		pb.Properties.User.Add(k, v)
+	}
 
-	_, err := h.c.Publish(ctx, pb)
+	_, err = h.cm.Publish(ctx, pb)
 	if err != nil {
 		return nil, err
 	}
@@ -132,10 +223,18 @@ func (h *Handler) Request(ctx context.Context, pb *paho.Publish) (*paho.Publish,
 	for {
 		select {
 		case <-time.After(h.requestTimeout):
-			return nil, ErrRequestTimeout
+			h.removeCorrelID(cID)
+			err = ErrRequestTimeout
+			return nil, err
 		case <-ctx.Done():
-			return nil, ctx.Err()
+			h.removeCorrelID(cID)
+			err = ctx.Err()
+			return nil, err
 		case resp := <-rChan:
+			if resp == nil {
+				err = ErrDisconnected
+				return nil, err
+			}
 			return resp, nil
 		}
 	}
@@ -148,8 +247,18 @@ func (h *Handler) responseHandler(pb *paho.Publish) {
 
 	rChan := h.getCorrelIDChan(string(pb.Properties.CorrelationData))
 	if rChan == nil {
+		lateResponsesTotal.WithLabelValues(pb.Topic).Inc()
+		h.logger().Debug("mqtt rpc response with unknown correlation ID", "topic", pb.Topic)
 		return
 	}
 
-	rChan <- pb
+	// rChan is buffered size-1 and getCorrelIDChan removed its entry, so this is
+	// its only send and never blocks the Paho router goroutine. If Request already
+	// gave up (timeout/ctx-cancel) before removeCorrelID ran, the response stays
+	// unread in the buffer; default is only a guard against a full buffer.
+	select {
+	case rChan <- pb:
+	default:
+		h.logger().Warn("mqtt rpc response dropped: receiver already gone", "topic", pb.Topic)
+	}
 }
@@ -0,0 +1,121 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+func TestCorrelDataLifecycle(t *testing.T) {
+	h := &Handler{correlData: make(map[string]chan *paho.Publish)}
+
+	rChan := make(chan *paho.Publish, 1)
+	h.addCorrelID("a", rChan)
+
+	if got := h.getCorrelIDChan("a"); got != rChan {
+		t.Fatalf("getCorrelIDChan(%q) = %v, want %v", "a", got, rChan)
+	}
+	if got := h.getCorrelIDChan("a"); got != nil {
+		t.Fatalf("getCorrelIDChan(%q) after delivery = %v, want nil", "a", got)
+	}
+
+	h.addCorrelID("b", make(chan *paho.Publish, 1))
+	h.removeCorrelID("b")
+	if got := h.getCorrelIDChan("b"); got != nil {
+		t.Fatalf("getCorrelIDChan(%q) after removeCorrelID = %v, want nil", "b", got)
+	}
+}
+
+func TestDrainCorrelDataDeliversDisconnect(t *testing.T) {
+	h := &Handler{correlData: make(map[string]chan *paho.Publish)}
+
+	waiting := make(chan *paho.Publish, 1)
+	h.addCorrelID("waiting", waiting)
+
+	// A request that already gave up (timeout/ctx-cancel) removes itself
+	// first, so drainCorrelData must not choke on the empty map entry.
+	h.addCorrelID("gave-up", make(chan *paho.Publish, 1))
+	h.removeCorrelID("gave-up")
+
+	h.drainCorrelData()
+
+	select {
+	case resp := <-waiting:
+		if resp != nil {
+			t.Fatalf("waiting channel received %v, want nil (disconnected)", resp)
+		}
+	default:
+		t.Fatal("drainCorrelData did not deliver to a still-waiting request")
+	}
+
+	if len(h.correlData) != 0 {
+		t.Fatalf("drainCorrelData left %d entries, want 0", len(h.correlData))
+	}
+}
+
+// TestCorrelDataConcurrentAddRemoveDrain exercises addCorrelID/removeCorrelID/
+// drainCorrelData from many goroutines at once; run with -race to confirm the
+// shared correlData map stays protected by Handler's mutex.
+func TestCorrelDataConcurrentAddRemoveDrain(t *testing.T) {
+	h := &Handler{correlData: make(map[string]chan *paho.Publish)}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cID := fmt.Sprintf("id-%d", i)
+			h.addCorrelID(cID, make(chan *paho.Publish, 1))
+			if i%2 == 0 {
+				h.removeCorrelID(cID)
+			} else {
+				h.getCorrelIDChan(cID)
+			}
+		}(i)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			h.drainCorrelData()
+		}
+	}()
+
+	wg.Wait()
+}
+
+func TestRequestRejectsWhenInFlightFull(t *testing.T) {
+	h := &Handler{
+		correlData: make(map[string]chan *paho.Publish),
+		inFlight:   make(chan struct{}, 1),
+	}
+	h.inFlight <- struct{}{} // occupy the only slot
+
+	_, err := h.Request(context.Background(), &paho.Publish{Topic: "svc/add"})
+	if !errors.Is(err, ErrTooManyRequests) {
+		t.Fatalf("Request() error = %v, want %v", err, ErrTooManyRequests)
+	}
+}
+
+func TestRequestWaitsWhenInFlightFullAndMaxInFlightWait(t *testing.T) {
+	h := &Handler{
+		correlData:      make(map[string]chan *paho.Publish),
+		inFlight:        make(chan struct{}, 1),
+		maxInFlightWait: true,
+	}
+	h.inFlight <- struct{}{} // occupy the only slot
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	_, err := h.Request(ctx, &paho.Publish{Topic: "svc/add"})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Request() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}